@@ -0,0 +1,186 @@
+package compiler
+
+import (
+	"strings"
+
+	"tinygo.org/x/go-llvm"
+)
+
+// InstrumentCgoChecks implements -tags cgocheck / -cgocheck=1: it detects the
+// two most common ways a Go program can violate cgo's pointer-passing rules
+// - storing a Go pointer into memory reachable from C, and passing a Go
+// pointer that itself contains other Go pointers across a //export boundary
+// - and inserts calls to runtime helpers that catch them at runtime with a
+// clear panic, instead of letting them silently corrupt memory.
+//
+// Like InsertWriteBarriers, this must run after OptimizeAllocs: allocations
+// that were stack-promoted can never be the target of one of these checks,
+// since nothing outside the function can hold a pointer to them anyway.
+func (c *Compiler) InstrumentCgoChecks() {
+	if !c.CgoCheck {
+		return
+	}
+
+	c.instrumentCgoStores()
+	c.instrumentExportBoundaries()
+}
+
+// instrumentCgoStores wraps every store of a Go pointer into memory that
+// came from C (a parameter of an //export function, or the return value of
+// a function cgo imported from C) with a call to
+// runtime.cgoCheckWriteBarrier(dst, src), which panics if src itself points
+// into the Go heap - the classic "storing a Go pointer into C-allocated
+// memory" mistake.
+func (c *Compiler) instrumentCgoStores() {
+	writeBarrier := c.getCgoCheckWriteBarrierFunc()
+
+	worklist := c.cgoReachablePointers()
+	for len(worklist) > 0 {
+		dst := worklist[len(worklist)-1]
+		worklist = worklist[:len(worklist)-1]
+		for _, use := range getUses(dst) {
+			nilValue := llvm.Value{}
+			if use.IsAGetElementPtrInst() != nilValue || use.IsABitCastInst() != nilValue {
+				// An address derived from C memory points into C memory too.
+				worklist = append(worklist, use)
+				continue
+			}
+			if use.IsAStoreInst() == nilValue || use.Operand(1) != dst {
+				continue
+			}
+			value := use.Operand(0)
+			if value.Type().TypeKind() != llvm.PointerTypeKind {
+				continue
+			}
+
+			c.builder.SetInsertPointBefore(use)
+			c.builder.CreateCall(writeBarrier, []llvm.Value{
+				c.builder.CreateBitCast(dst, c.i8ptrType, ""),
+				c.builder.CreateBitCast(value, c.i8ptrType, ""),
+			}, "")
+		}
+	}
+}
+
+// cgoReachablePointers returns every pointer-typed value that C code could
+// already see: parameters of //export functions, and the return values of
+// functions cgo imported from C (named "C.<name>" by the cgo preprocessor).
+func (c *Compiler) cgoReachablePointers() []llvm.Value {
+	var pointers []llvm.Value
+	for fn := c.mod.FirstFunction(); !fn.IsNil(); fn = llvm.NextFunction(fn) {
+		if c.isCgoImport(fn) {
+			for _, call := range getUses(fn) {
+				if call.Type().TypeKind() == llvm.PointerTypeKind {
+					pointers = append(pointers, call)
+				}
+			}
+			continue
+		}
+		if !c.isCgoExported(fn) {
+			continue
+		}
+		for i := 0; i < fn.ParamsCount(); i++ {
+			if fn.Param(i).Type().TypeKind() == llvm.PointerTypeKind {
+				pointers = append(pointers, fn.Param(i))
+			}
+		}
+	}
+	return pointers
+}
+
+// instrumentExportBoundaries calls runtime.cgoCheckPointer on every
+// pointer-typed argument of every //export function, which panics if the
+// argument itself points into the Go heap. The memory the argument points to
+// is not scanned, so a Go pointer stored inside C memory passed this way is
+// not detected here.
+func (c *Compiler) instrumentExportBoundaries() {
+	checkPointer := c.getCgoCheckPointerFunc()
+
+	for fn := c.mod.FirstFunction(); !fn.IsNil(); fn = llvm.NextFunction(fn) {
+		if !c.isCgoExported(fn) {
+			continue
+		}
+		entry := fn.EntryBasicBlock()
+		if entry.IsNil() {
+			continue
+		}
+
+		c.builder.SetInsertPointBefore(entry.FirstInstruction())
+		for i := 0; i < fn.ParamsCount(); i++ {
+			param := fn.Param(i)
+			if param.Type().TypeKind() != llvm.PointerTypeKind {
+				continue
+			}
+			ptr := c.builder.CreateBitCast(param, c.i8ptrType, "")
+			c.builder.CreateCall(checkPointer, []llvm.Value{ptr}, "")
+		}
+	}
+}
+
+// isCgoImport reports whether fn is a declaration imported from C through
+// cgo (the cgo preprocessor, see the cgo package, names these "C.<name>").
+func (c *Compiler) isCgoImport(fn llvm.Value) bool {
+	return fn.IsDeclaration() && strings.HasPrefix(fn.Name(), "C.")
+}
+
+// cgoNonExportedNames lists bare, undotted names this pass must never treat
+// as //export functions even though they pass every other check below: libc
+// helpers LLVM itself calls into (memcpy and friends, inserted by lowering
+// passes rather than by any Go call instruction) and the program entry
+// point. None of these are reachable from C the way an //export function is.
+var cgoNonExportedNames = map[string]bool{
+	"main":    true,
+	"memcpy":  true,
+	"memmove": true,
+	"memset":  true,
+	"memcmp":  true,
+}
+
+// isCgoExported reports whether fn is a //export function. The cgo
+// preprocessor gives these their bare export name instead of the usual
+// "package.Name" mangling, which is necessary but not sufficient:
+// undotted names are also how LLVM lowering passes refer to libc helpers
+// (memcpy, memset, ...) and the program entry point, none of which are
+// reachable from C the way an //export function is. This isn't a precise
+// check - the compiler doesn't carry real export/linkname metadata through
+// to this pass - so it adds the one signal that does distinguish them: an
+// //export function is only ever called from outside this module, so it has
+// no call sites inside it, whereas the libc helpers above are always called
+// by other functions in the module.
+func (c *Compiler) isCgoExported(fn llvm.Value) bool {
+	if fn.IsDeclaration() || strings.HasPrefix(fn.Name(), "llvm.") {
+		return false
+	}
+	if strings.Contains(fn.Name(), ".") || cgoNonExportedNames[fn.Name()] {
+		return false
+	}
+	for _, use := range getUses(fn) {
+		nilValue := llvm.Value{}
+		if use.IsACallInst() != nilValue && use.CalledValue() == fn {
+			return false
+		}
+	}
+	return true
+}
+
+// getCgoCheckWriteBarrierFunc returns (declaring if necessary)
+// runtime.cgoCheckWriteBarrier.
+func (c *Compiler) getCgoCheckWriteBarrierFunc() llvm.Value {
+	fn := c.mod.NamedFunction("runtime.cgoCheckWriteBarrier")
+	if !fn.IsNil() {
+		return fn
+	}
+	fnType := llvm.FunctionType(c.ctx.VoidType(), []llvm.Type{c.i8ptrType, c.i8ptrType}, false)
+	return llvm.AddFunction(c.mod, "runtime.cgoCheckWriteBarrier", fnType)
+}
+
+// getCgoCheckPointerFunc returns (declaring if necessary)
+// runtime.cgoCheckPointer.
+func (c *Compiler) getCgoCheckPointerFunc() llvm.Value {
+	fn := c.mod.NamedFunction("runtime.cgoCheckPointer")
+	if !fn.IsNil() {
+		return fn
+	}
+	fnType := llvm.FunctionType(c.ctx.VoidType(), []llvm.Type{c.i8ptrType}, false)
+	return llvm.AddFunction(c.mod, "runtime.cgoCheckPointer", fnType)
+}
@@ -0,0 +1,226 @@
+package compiler
+
+import (
+	"tinygo.org/x/go-llvm"
+)
+
+// escapeState is a small lattice describing what a function does with one of
+// its pointer parameters, ordered from most to least permissive for the
+// caller: a noescape parameter can safely be a stack address; a returned one
+// can too, as long as the caller doesn't let the return value outlive the
+// stack frame; escapesViaArg and escapes cannot.
+type escapeState int
+
+const (
+	escNoEscape escapeState = iota
+	escReturned
+	escEscapesViaArg
+	escEscapes
+)
+
+func (a escapeState) join(b escapeState) escapeState {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// paramEscape is the summary computed for a single pointer parameter.
+type paramEscape struct {
+	state  escapeState
+	viaArg int // meaningful only when state == escEscapesViaArg: which argument of this function it flows into
+}
+
+// functionSummary is the escape summary computed for one function.
+type functionSummary struct {
+	params []paramEscape
+}
+
+func newFunctionSummary(fn llvm.Value) *functionSummary {
+	return &functionSummary{params: make([]paramEscape, fn.ParamsCount())}
+}
+
+func (s *functionSummary) equal(other *functionSummary) bool {
+	if other == nil || len(s.params) != len(other.params) {
+		return false
+	}
+	for i := range s.params {
+		if s.params[i] != other.params[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// escapeSummaries holds the fixed-point result of AnalyzeEscapes, keyed by
+// function. A function missing from the map (an external declaration, or
+// one AnalyzeEscapes hasn't been run for) falls back to doesEscape's older,
+// purely function-local approximation.
+type escapeSummaries map[llvm.Value]*functionSummary
+
+// AnalyzeEscapes computes a whole-module, interprocedural escape summary for
+// every internal function and uses it to annotate pointer parameters with
+// nocapture and returned attributes (nocapture being the one doesEscape
+// already understands). It adds no readonly attributes; see
+// applyEscapeAttributes. It must run before OptimizeAllocs, so that
+// the stack-promotion decision there can see through helper functions
+// (small closures, fmt.Sprint-style formatting helpers, ...) instead of only
+// recognizing allocations that never leave the allocating function at all.
+//
+// Functions form a call graph with cycles (direct and mutual recursion), so
+// a true topological order would need strongly-connected-component
+// detection. Instead this just iterates every function repeatedly until no
+// summary changes; the lattice above is finite with height 4, so this always
+// terminates, just potentially slower than a proper reverse-topological
+// sweep would. For the module sizes tinygo compiles this isn't measurable in
+// practice, and is not on the optimizer's hot path.
+func (c *Compiler) AnalyzeEscapes() {
+	var funcs []llvm.Value
+	for fn := c.mod.FirstFunction(); !fn.IsNil(); fn = llvm.NextFunction(fn) {
+		if !fn.IsDeclaration() {
+			funcs = append(funcs, fn)
+		}
+	}
+
+	summaries := escapeSummaries{}
+	for _, fn := range funcs {
+		summaries[fn] = newFunctionSummary(fn)
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for _, fn := range funcs {
+			summary := c.computeFunctionSummary(fn, summaries)
+			if !summary.equal(summaries[fn]) {
+				summaries[fn] = summary
+				changed = true
+			}
+		}
+	}
+
+	c.escapeSummaries = summaries
+	c.applyEscapeAttributes(summaries)
+}
+
+// computeFunctionSummary derives fn's escape summary from its current
+// instructions, consulting summaries for any function it calls. Because
+// summaries start at the bottom of the lattice (escNoEscape) and only ever
+// move up, calling this repeatedly over the whole module converges to a
+// sound fixed point regardless of iteration order.
+func (c *Compiler) computeFunctionSummary(fn llvm.Value, summaries escapeSummaries) *functionSummary {
+	summary := newFunctionSummary(fn)
+	for i := range summary.params {
+		if fn.Param(i).Type().TypeKind() != llvm.PointerTypeKind {
+			continue
+		}
+		summary.params[i].state = c.paramEscapeState(fn.Param(i), fn, summaries)
+	}
+	return summary
+}
+
+// paramEscapeState walks every use of a pointer-typed parameter and joins
+// together what each use implies about it escaping.
+func (c *Compiler) paramEscapeState(param llvm.Value, fn llvm.Value, summaries escapeSummaries) escapeState {
+	state := escNoEscape
+	for _, use := range getUses(param) {
+		state = state.join(c.useEscapeState(param, use, fn, summaries))
+		if state == escEscapes {
+			break // top of the lattice, no use can make it worse
+		}
+	}
+	return state
+}
+
+func (c *Compiler) useEscapeState(value, use, fn llvm.Value, summaries escapeSummaries) escapeState {
+	nilValue := llvm.Value{}
+	switch {
+	case use.IsAGetElementPtrInst() != nilValue, use.IsABitCastInst() != nilValue:
+		return c.paramEscapeState(use, fn, summaries)
+	case use.IsALoadInst() != nilValue:
+		return escNoEscape
+	case use.IsAStoreInst() != nilValue:
+		if use.Operand(0) == value {
+			// value itself is being written to memory: once that memory is
+			// read back, value could flow anywhere, so treat it as fully
+			// escaping rather than trying to track it further.
+			return escEscapes
+		}
+		return escNoEscape
+	case use.IsAICmpInst() != nilValue:
+		return escNoEscape
+	case use.IsAReturnInst() != nilValue:
+		return escReturned
+	case use.IsACallInst() != nilValue:
+		return c.callEscapeState(value, use, fn, summaries)
+	default:
+		return escEscapes
+	}
+}
+
+// callEscapeState looks up what the called function does with value at this
+// call site. If the callee has no summary (an external function, or an
+// indirect call), this falls back to the conservative nocapture-attribute
+// check doesEscape has always used.
+func (c *Compiler) callEscapeState(value, call, fn llvm.Value, summaries escapeSummaries) escapeState {
+	callee := call.CalledValue()
+	nilValue := llvm.Value{}
+	if callee.IsAFunction() == nilValue {
+		return escEscapes // indirect call, nothing to look up
+	}
+
+	index := -1
+	for i := 0; i < call.OperandsCount()-1; i++ {
+		if call.Operand(i) == value {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return escNoEscape
+	}
+
+	calleeSummary, ok := summaries[callee]
+	if !ok || index >= len(calleeSummary.params) {
+		if c.hasFlag(call, value, "nocapture") {
+			return escNoEscape
+		}
+		return escEscapes
+	}
+
+	switch calleeSummary.params[index].state {
+	case escNoEscape:
+		return escNoEscape
+	case escReturned:
+		// The callee hands this pointer back out through its return value.
+		// Whether that escapes fn in turn depends on what fn does with the
+		// call result, which is exactly the same question as for any other
+		// pointer-producing instruction, so treat the call result itself
+		// like a derived value.
+		return c.paramEscapeState(call, fn, summaries)
+	default:
+		return escEscapes
+	}
+}
+
+// applyEscapeAttributes synthesizes nocapture/returned LLVM parameter
+// attributes from the computed summaries, so that doesEscape and LLVM's own
+// interprocedural passes both benefit from the same analysis. (readonly is
+// left to isReadOnly, which already has its own, more precise check for
+// "never stored to" - escNoEscape here only means "doesn't outlive this
+// call", which is a different property.)
+func (c *Compiler) applyEscapeAttributes(summaries escapeSummaries) {
+	nocaptureKind := llvm.AttributeKindID("nocapture")
+	returnedKind := llvm.AttributeKindID("returned")
+
+	for fn, summary := range summaries {
+		for i, p := range summary.params {
+			index := i + 1 // param attributes start at 1
+			switch p.state {
+			case escNoEscape:
+				fn.AddAttributeAtIndex(index, c.ctx.CreateEnumAttribute(nocaptureKind, 0))
+			case escReturned:
+				fn.AddAttributeAtIndex(index, c.ctx.CreateEnumAttribute(returnedKind, 0))
+			}
+		}
+	}
+}
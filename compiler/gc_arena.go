@@ -0,0 +1,31 @@
+package compiler
+
+import (
+	"tinygo.org/x/go-llvm"
+)
+
+// arenaChunkReservers names the runtime functions that call runtime.alloc to
+// reserve a new arena chunk (the slow path behind runtime/arena.NewArena,
+// arena.New, and arena.MakeSlice).
+var arenaChunkReservers = map[string]bool{
+	"runtime.newArenaChunk":       true,
+	"runtime.newArenaChunkOfSize": true,
+}
+
+// arenaAllocSites returns the set of runtime.alloc call sites that reserve
+// an arena chunk. OptimizeAllocs must never stack-promote these: the memory
+// they return is handed to package arena and is expected to live for as
+// long as the *Arena does, which can easily outlive the function that
+// reserved the chunk - something the simple, function-local escape
+// analysis in OptimizeAllocs can't see through a value stored into a
+// long-lived *Arena.
+func (c *Compiler) arenaAllocSites(heapallocs []llvm.Value) map[llvm.Value]bool {
+	sites := map[llvm.Value]bool{}
+	for _, heapalloc := range heapallocs {
+		fn := heapalloc.InstructionParent().Parent()
+		if arenaChunkReservers[fn.Name()] {
+			sites[heapalloc] = true
+		}
+	}
+	return sites
+}
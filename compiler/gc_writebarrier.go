@@ -0,0 +1,104 @@
+package compiler
+
+import (
+	"tinygo.org/x/go-llvm"
+)
+
+// gcIsConcurrent returns whether the concurrent tricolor collector
+// (-gc=concurrent, build tag gc.concurrent) was selected for this build. It
+// follows the same pattern as gcIsPrecise.
+func (c *Compiler) gcIsConcurrent() bool {
+	return c.GC == "concurrent"
+}
+
+// InsertWriteBarriers is a peer of LowerInterfaces/LowerGoroutines: a
+// mandatory lowering pass that runs whenever the concurrent collector is in
+// use. The concurrent collector interleaves marking with running goroutines,
+// so a pointer store that the mutator performs between two mark increments
+// must be reported to the collector or it may sweep an object that became
+// reachable only through that store (the classic "lost update" race for a
+// Dijkstra-style tricolor GC). This pass inserts a call to
+// runtime.writeBarrier(slot, newVal) before every store of a pointer-typed
+// value into a heap or global location, which shades newVal grey if a
+// collection is in progress; the store itself is kept.
+//
+// It must run after OptimizeAllocs, so that stores into allocas that were
+// stack-promoted (and can therefore never need a barrier) have already been
+// rewritten to plain stack stores and are skipped here.
+func (c *Compiler) InsertWriteBarriers() {
+	if !c.gcIsConcurrent() {
+		return
+	}
+
+	writeBarrier := c.getWriteBarrierFunc()
+
+	for fn := c.mod.FirstFunction(); !fn.IsNil(); fn = llvm.NextFunction(fn) {
+		for bb := fn.FirstBasicBlock(); !bb.IsNil(); bb = llvm.NextBasicBlock(bb) {
+			for inst := bb.FirstInstruction(); !inst.IsNil(); {
+				next := llvm.NextInstruction(inst)
+				if c.needsWriteBarrier(inst) {
+					c.insertWriteBarrier(inst, writeBarrier)
+				}
+				inst = next
+			}
+		}
+	}
+}
+
+// needsWriteBarrier reports whether inst is a store that the concurrent
+// collector must be told about: it stores a pointer-typed value into a
+// location other than a stack alloca, and the value being stored isn't
+// trivially nil or otherwise not a heap pointer.
+func (c *Compiler) needsWriteBarrier(inst llvm.Value) bool {
+	nilValue := llvm.Value{}
+	if inst.IsAStoreInst() == nilValue {
+		return false
+	}
+
+	value := inst.Operand(0)
+	if value.Type().TypeKind() != llvm.PointerTypeKind {
+		// Not storing a pointer, so it can never create a new reference the
+		// collector needs to know about.
+		return false
+	}
+	if !value.IsAConstant().IsNil() {
+		// Storing a nil or other compile-time constant pointer can't
+		// resurrect garbage: the collector already knows about anything a
+		// constant can point to (it's reachable from a global or not heap
+		// memory at all).
+		return false
+	}
+
+	dst := inst.Operand(1)
+	if !dst.IsAAllocaInst().IsNil() {
+		// OptimizeAllocs runs before this pass; anything still stored into an
+		// alloca lives on the stack for the whole function and is scanned
+		// directly by markStackRoots, so no barrier is needed.
+		return false
+	}
+
+	return true
+}
+
+// insertWriteBarrier replaces a plain store instruction with a call to
+// runtime.writeBarrier(slot, newVal) followed by the original store (the
+// barrier only shades the object grey, it doesn't perform the write itself).
+func (c *Compiler) insertWriteBarrier(store llvm.Value, writeBarrier llvm.Value) {
+	value := store.Operand(0)
+	dst := store.Operand(1)
+
+	c.builder.SetInsertPointBefore(store)
+	slot := c.builder.CreateBitCast(dst, c.i8ptrType, "")
+	newVal := c.builder.CreateBitCast(value, c.i8ptrType, "")
+	c.builder.CreateCall(writeBarrier, []llvm.Value{slot, newVal}, "")
+}
+
+// getWriteBarrierFunc returns (declaring if necessary) runtime.writeBarrier.
+func (c *Compiler) getWriteBarrierFunc() llvm.Value {
+	fn := c.mod.NamedFunction("runtime.writeBarrier")
+	if !fn.IsNil() {
+		return fn
+	}
+	fnType := llvm.FunctionType(c.ctx.VoidType(), []llvm.Type{c.i8ptrType, c.i8ptrType}, false)
+	return llvm.AddFunction(c.mod, "runtime.writeBarrier", fnType)
+}
@@ -46,7 +46,10 @@ func (c *Compiler) Optimize(optLevel, sizeLevel int, inlinerThreshold uint) erro
 		// Run Go-specific optimization passes.
 		c.OptimizeMaps()
 		c.OptimizeStringToBytes()
+		c.AnalyzeEscapes()
 		c.OptimizeAllocs()
+		c.InsertWriteBarriers()
+		c.InstrumentCgoChecks()
 		c.LowerInterfaces()
 		c.LowerFuncValues()
 
@@ -56,6 +59,7 @@ func (c *Compiler) Optimize(optLevel, sizeLevel int, inlinerThreshold uint) erro
 		goPasses.Run(c.mod)
 
 		// Run TinyGo-specific interprocedural optimizations.
+		c.AnalyzeEscapes()
 		c.OptimizeAllocs()
 		c.OptimizeStringToBytes()
 
@@ -81,6 +85,8 @@ func (c *Compiler) Optimize(optLevel, sizeLevel int, inlinerThreshold uint) erro
 		}
 	} else {
 		// Must be run at any optimization level.
+		c.InsertWriteBarriers()
+		c.InstrumentCgoChecks()
 		c.LowerInterfaces()
 		c.LowerFuncValues()
 		err := c.LowerGoroutines()
@@ -115,7 +121,11 @@ func (c *Compiler) Optimize(optLevel, sizeLevel int, inlinerThreshold uint) erro
 	builder.Populate(modPasses)
 	modPasses.Run(c.mod)
 
-	if c.gcIsPrecise() {
+	if c.gcIsPrecise() || c.gcIsConcurrent() {
+		// gc.concurrent's root shading (gc_concurrent.go's markGlobals) needs
+		// the same trackedGlobalsStart/Length/Bitmap tables gc.precise's
+		// markGlobals reads; addGlobalsBitmap doesn't care which collector
+		// consumes what it emits.
 		c.addGlobalsBitmap()
 		if err := c.Verify(); err != nil {
 			return errors.New("GC pass caused a verification failure")
@@ -188,7 +198,9 @@ func (c *Compiler) OptimizeMaps() {
 
 // Transform runtime.stringToBytes(...) calls into const []byte slices whenever
 // possible. This optimizes the following pattern:
-//     w.Write([]byte("foo"))
+//
+//	w.Write([]byte("foo"))
+//
 // where Write does not store to the slice.
 func (c *Compiler) OptimizeStringToBytes() {
 	stringToBytes := c.mod.NamedFunction("runtime.stringToBytes")
@@ -236,8 +248,29 @@ func (c *Compiler) OptimizeStringToBytes() {
 	}
 }
 
+// stackPromotionMaxPerAlloc is the largest single allocation OptimizeAllocs
+// will ever consider moving to the stack.
+// stackPromotionFrameBudget bounds how much of that a single function can
+// use in total: a function that stack-promotes many small, non-escaping
+// allocations can still blow its stack frame even though each one
+// individually looks cheap.
+const (
+	stackPromotionMaxPerAlloc = 256
+	stackPromotionFrameBudget = 1024
+)
+
 // Basic escape analysis: translate runtime.alloc calls into alloca
-// instructions.
+// instructions. Escaping is determined per call site by doesEscape, which
+// since AnalyzeEscapes runs beforehand can see through helper functions
+// (closures, small formatting helpers, ...) via their computed summaries,
+// not just direct uses in this function.
+//
+// Optimize calls this twice per compilation (once before LowerInterfaces,
+// once after), so stackPromotionFrameBudget has to be tracked on c rather
+// than in a map local to this function: a map rebuilt on every call would
+// let a function accumulate up to 2x its documented per-function cap across
+// the two passes instead of the single whole-compilation budget the
+// constant's name promises.
 func (c *Compiler) OptimizeAllocs() {
 	allocator := c.mod.NamedFunction("runtime.alloc")
 	if allocator.IsNil() {
@@ -246,18 +279,36 @@ func (c *Compiler) OptimizeAllocs() {
 	}
 
 	heapallocs := getUses(allocator)
+	arenaAllocs := c.arenaAllocSites(heapallocs)
+	if c.allocFrameBudget == nil {
+		c.allocFrameBudget = map[llvm.Value]uint64{}
+	}
+	frameBudget := c.allocFrameBudget
 	for _, heapalloc := range heapallocs {
+		if arenaAllocs[heapalloc] {
+			// This allocation backs an arena chunk (see gc_arena.go) and must
+			// stay on the heap for as long as the arena is alive, which this
+			// function-local analysis can't prove either way.
+			continue
+		}
 		nilValue := llvm.Value{}
 		if heapalloc.Operand(0).IsAConstant() == nilValue {
 			// Do not allocate variable length arrays on the stack.
 			continue
 		}
 		size := heapalloc.Operand(0).ZExtValue()
-		if size > 256 {
-			// The maximum value for a stack allocation.
+		if size > stackPromotionMaxPerAlloc {
+			// The maximum value for a single stack allocation.
 			// TODO: tune this, this is just a random value.
 			continue
 		}
+		fn := heapalloc.InstructionParent().Parent()
+		if frameBudget[fn]+size > stackPromotionFrameBudget {
+			// This function has already promoted enough allocations that
+			// giving it another one risks blowing its stack frame, even
+			// though this individual allocation would fit on its own.
+			continue
+		}
 
 		// In general the pattern is:
 		//     %0 = call i8* @runtime.alloc(i32 %size)
@@ -274,7 +325,7 @@ func (c *Compiler) OptimizeAllocs() {
 		if !c.doesEscape(bitcast) {
 			// Insert alloca in the entry block. Do it here so that mem2reg can
 			// promote it to a SSA value.
-			fn := bitcast.InstructionParent().Parent()
+			frameBudget[fn] += size
 			c.builder.SetInsertPointBefore(fn.EntryBasicBlock().FirstInstruction())
 			alignment := c.targetData.ABITypeAlignment(c.i8ptrType)
 			sizeInWords := (size + uint64(alignment) - 1) / uint64(alignment)
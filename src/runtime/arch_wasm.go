@@ -46,4 +46,22 @@ func getCurrentStackPointer() uintptr {
 	//       https://github.com/WebAssembly/design/issues/338#issuecomment-139400926
 	return stackTop
 	// return arm.ReadRegister("sp")
-}
\ No newline at end of file
+}
+
+// wasmMemoryGrow is the raw wasm memory.grow instruction: it grows linear
+// memory 0 by delta 64KiB pages and returns the previous size in pages, or -1
+// if the grow would exceed the module's declared memory.maximum.
+//
+//export llvm.wasm.memory.grow.i32
+func wasmMemoryGrow(mem int32, delta int32) int32
+
+// growHeap grows the wasm linear memory by the given number of 64KiB pages,
+// returning the previous size in pages, or false if the grow instruction
+// refused (typically because it would exceed memory.maximum).
+func growHeap(pages uintptr) (previousPages uintptr, ok bool) {
+	prev := wasmMemoryGrow(0, int32(pages))
+	if prev < 0 {
+		return 0, false
+	}
+	return uintptr(prev), true
+}
@@ -0,0 +1,130 @@
+// +build gc.precise
+
+package runtime
+
+import "unsafe"
+
+// arenaChunkSize is the size of each region an Arena reserves from the heap.
+// An arena that outgrows its current chunk reserves another of the same
+// size and links it on, rather than resizing (so existing bump-allocated
+// pointers never move).
+const arenaChunkSize = 32 * 1024
+
+// arenaChunk is one region bump-allocated from; base/size describe the
+// region reserved from the normal heap, off is how much of it has been
+// handed out so far.
+type arenaChunk struct {
+	base uintptr
+	size uintptr
+	off  uintptr
+	next *arenaChunk
+}
+
+// arenaZones tracks every chunk belonging to a still-live arena. Each cycle,
+// GC keeps the blocks backing these chunks from being swept and scans what's
+// been bump-allocated into them for outgoing pointers into the GC heap,
+// exactly like any other root range (see markArenas below).
+// Arena memory is otherwise invisible to the collector: nothing outside an
+// arena may point into it, so nothing needs to trace inbound references the
+// other way.
+var arenaZones []*arenaChunk
+
+// arena_runtime_newArena is linked into package arena as arena.newArena.
+// It reserves the first chunk for a new Arena.
+func arena_runtime_newArena() unsafe.Pointer {
+	return unsafe.Pointer(newArenaChunk())
+}
+
+func newArenaChunk() *arenaChunk {
+	base := alloc(arenaChunkSize)
+	chunk := &arenaChunk{base: uintptr(base), size: arenaChunkSize}
+	arenaZones = append(arenaZones, chunk)
+	return chunk
+}
+
+// arena_runtime_arenaNew is linked into package arena as arena.arenaAlloc.
+// It bump-allocates size bytes (aligned to align) from a, reserving a new
+// chunk if the current one doesn't have enough room left; a single value is
+// never split across two chunks.
+func arena_runtime_arenaNew(a unsafe.Pointer, size, align uintptr) unsafe.Pointer {
+	chunk := (*arenaChunk)(a)
+	for chunk.next != nil {
+		chunk = chunk.next
+	}
+
+	start := (chunk.base + chunk.off + align - 1) &^ (align - 1)
+	if start+size > chunk.base+chunk.size {
+		if size > arenaChunkSize {
+			// Oversized request: give it its own chunk sized to fit.
+			chunk.next = newArenaChunkOfSize(size + align)
+		} else {
+			chunk.next = newArenaChunk()
+		}
+		chunk = chunk.next
+		start = (chunk.base + align - 1) &^ (align - 1)
+	}
+
+	chunk.off = start + size - chunk.base
+	ptr := unsafe.Pointer(start)
+	memzero(ptr, size)
+	return ptr
+}
+
+func newArenaChunkOfSize(size uintptr) *arenaChunk {
+	base := alloc(size)
+	chunk := &arenaChunk{base: uintptr(base), size: size}
+	arenaZones = append(arenaZones, chunk)
+	return chunk
+}
+
+// arena_runtime_arenaFree is linked into package arena as arena.arenaFree.
+// It returns every chunk belonging to a straight to the free list with no
+// per-object bookkeeping: unlike a regular GC sweep, it doesn't need to know
+// which objects inside the arena are still referenced, because the whole
+// region is going away together.
+func arena_runtime_arenaFree(a unsafe.Pointer) {
+	chunk := (*arenaChunk)(a)
+	for chunk != nil {
+		removeArenaZone(chunk)
+		freeArenaChunk(chunk)
+		chunk = chunk.next
+	}
+}
+
+func removeArenaZone(chunk *arenaChunk) {
+	for i, z := range arenaZones {
+		if z == chunk {
+			arenaZones = append(arenaZones[:i], arenaZones[i+1:]...)
+			return
+		}
+	}
+}
+
+// markArenas is called from GC() (gc_precise.go) after the normal mark phase
+// but before sweep. For every chunk belonging to a live arena it marks the
+// backing blocks reachable, so sweep leaves them alone, and conservatively
+// scans the bump-allocated portion for pointers into the regular GC heap,
+// since arena-resident values are allowed to reference heap objects (just
+// not the other way around).
+func markArenas() {
+	for _, chunk := range arenaZones {
+		head := blockFromAddr(chunk.base).findHead()
+		next := head.findNext()
+		for block := head; block.address() < next.address(); block++ {
+			block.setState(blockStateMark)
+		}
+		// markRoots needs an aligned end; round the used part up to a word.
+		wordSize := unsafe.Sizeof(uintptr(0))
+		markRoots(chunk.base, (chunk.base+chunk.off+wordSize-1)&^(wordSize-1))
+	}
+}
+
+// freeArenaChunk marks every block backing chunk as free directly, bypassing
+// the usual mark/sweep bookkeeping entirely.
+func freeArenaChunk(chunk *arenaChunk) {
+	head := blockFromAddr(chunk.base).findHead()
+	next := head.findNext()
+	for block := head; block.address() < next.address(); block++ {
+		block.setState(blockStateFree)
+	}
+}
@@ -0,0 +1,41 @@
+// Package arena provides bump allocation into a region that can be freed as
+// a whole, with no per-object bookkeeping. It mirrors the arena API added to
+// recent versions of upstream Go.
+//
+// Values allocated from an Arena must not be used after that Arena's Free
+// method has been called: the memory backing them may have been reused for
+// something else by then.
+package arena
+
+import "unsafe"
+
+// Arena is a region of memory that can be bump-allocated into and freed all
+// at once.
+type Arena struct {
+	ptr unsafe.Pointer
+}
+
+// NewArena creates a new, empty Arena.
+func NewArena() *Arena {
+	return &Arena{ptr: newArena()}
+}
+
+// New allocates a single T from a, zeroed, and returns a pointer to it.
+func New[T any](a *Arena) *T {
+	var zero T
+	return (*T)(arenaAlloc(a.ptr, unsafe.Sizeof(zero), unsafe.Alignof(zero)))
+}
+
+// MakeSlice allocates a []T of the given length and capacity from a, zeroed.
+func MakeSlice[T any](a *Arena, len, cap int) []T {
+	var zero T
+	data := arenaAlloc(a.ptr, unsafe.Sizeof(zero)*uintptr(cap), unsafe.Alignof(zero))
+	return unsafe.Slice((*T)(data), cap)[:len:cap]
+}
+
+// Free returns the memory backing a to the allocator. Every value allocated
+// from a becomes invalid the moment Free returns.
+func (a *Arena) Free() {
+	arenaFree(a.ptr)
+	a.ptr = nil
+}
@@ -0,0 +1,20 @@
+// +build gc.precise
+
+package arena
+
+import "unsafe"
+
+// newArena, arenaAlloc, and arenaFree are linked into the runtime functions
+// that actually implement arenas (src/runtime/arena.go), which only exist
+// when compiling with -gc=precise: arenas keep their chunks alive by marking
+// them during gc_precise.go's GC(), and no other collector in this series
+// knows to do that yet (see arena_unsupported.go).
+
+//go:linkname newArena runtime.arena_runtime_newArena
+func newArena() unsafe.Pointer
+
+//go:linkname arenaAlloc runtime.arena_runtime_arenaNew
+func arenaAlloc(a unsafe.Pointer, size, align uintptr) unsafe.Pointer
+
+//go:linkname arenaFree runtime.arena_runtime_arenaFree
+func arenaFree(a unsafe.Pointer)
@@ -0,0 +1,11 @@
+// +build !gc.precise
+
+package arena
+
+// Package arena is only implemented for the gc.precise collector: an
+// Arena's chunks are kept alive by being marked during gc_precise.go's GC(),
+// and no other collector in this series (gc.concurrent) knows about arenas
+// at all yet. Building a program that imports this package with any other
+// -gc= setting used to fail at link time instead, with an undefined-symbol
+// error nowhere near this package. Force a clear compile error here instead.
+var _ = runtime_arena_package_requires_dash_gc_equals_precise
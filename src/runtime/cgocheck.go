@@ -0,0 +1,37 @@
+// +build cgocheck
+
+package runtime
+
+import "unsafe"
+
+// cgoCheckWriteBarrier is called by compiler-inserted code
+// (compiler.InstrumentCgoChecks) before every store into memory already
+// reachable from C: a parameter of an //export function, or the result of a
+// function cgo imported from C. If src points into the Go heap, storing it
+// into dst would hand C code a Go pointer without going through cgo's
+// pinning rules, so this panics instead of letting it corrupt memory
+// silently later, when the GC moves or frees the object out from under C.
+func cgoCheckWriteBarrier(dst, src unsafe.Pointer) {
+	if addressOnHeap(uintptr(dst)) {
+		// Go code writing into its own heap is always fine; only writes into
+		// C-controlled memory need checking.
+		return
+	}
+	if addressOnHeap(uintptr(src)) {
+		runtimePanic("cgo: storing a Go pointer into C-allocated memory")
+	}
+}
+
+// cgoCheckPointer is called by compiler-inserted code at the start of every
+// //export function, once per pointer-typed argument. It panics if the
+// argument itself points into the Go heap (passing something straight out of
+// the Go heap instead of a C.malloc'd copy). The memory the argument points
+// to is not scanned, so Go pointers stored inside it are not detected.
+func cgoCheckPointer(ptr unsafe.Pointer) {
+	if ptr == nil {
+		return
+	}
+	if addressOnHeap(uintptr(ptr)) {
+		runtimePanic("cgo: passed a Go pointer to C that is itself Go-heap memory")
+	}
+}
@@ -0,0 +1,370 @@
+// +build gc.concurrent
+
+package runtime
+
+import (
+	"unsafe"
+)
+
+//go:extern runtime.trackedGlobalsStart
+var trackedGlobalsStart uintptr
+
+//go:extern runtime.trackedGlobalsLength
+var trackedGlobalsLength uintptr
+
+//go:extern runtime.trackedGlobalsBitmap
+var trackedGlobalsBitmap [0]uint8
+
+// gcColor is the tricolor state of a block, as used by the Dijkstra-style
+// incremental collector below. It replaces the simple mark/free state used
+// by gc.precise: white means "not yet visited this cycle" (and thus
+// collectible once the cycle finishes), grey means "reachable but its
+// children haven't been scanned yet", and black means "reachable and fully
+// scanned".
+type gcColor uint8
+
+const (
+	gcWhite gcColor = iota
+	gcGrey
+	gcBlack
+	gcFree
+)
+
+// colorStart is the base address of the 2-bit-per-block color table,
+// allocated the same way the mark bitmap is in gc.precise: as a region
+// carved out of the front of the heap.
+var colorStart uintptr
+
+// greyQueue holds the addresses of every grey block, in LIFO order. Marking
+// makes progress by popping an entry, scanning it (turning it black and
+// shading everything it points to grey), and is run a little at a time so
+// that a mutator allocating during a long mark phase never stalls for the
+// whole cycle.
+var greyQueue []uintptr
+
+// gcPhase tracks whether a mark cycle is currently in progress. While marking
+// is in progress, writeBarrier must shade newly-stored pointers grey so the
+// mutator can never hide an object from the collector by moving the only
+// reference to it into an already-scanned (black) object.
+var gcPhase = gcPhaseIdle
+
+const (
+	gcPhaseIdle = iota
+	gcPhaseMarking
+	gcPhaseSweeping
+)
+
+// gcGrowthRatio is the GOGC-style knob: a new cycle starts once the heap has
+// grown by this percentage of its size after the previous collection. 100
+// means "collect again once the heap has doubled", matching Go's default
+// GOGC=100.
+var gcGrowthRatio uintptr = 100
+
+// liveSizeAtLastGC and sweepCursor track, respectively, how much memory was
+// live after the previous cycle (used to decide when to start the next one)
+// and where the lazy sweeper left off.
+var (
+	liveSizeAtLastGC uintptr
+	sweepCursor      gcBlock
+)
+
+// gcPauseStats accumulates pause statistics reported through gcDebug output.
+// Unlike the stop-the-world collector, a "pause" here is one small mark
+// increment rather than an entire cycle.
+var gcPauseStats struct {
+	cycles     uintptr
+	increments uintptr
+}
+
+func init() {
+	totalSize := heapEnd - heapStart
+
+	// Reserve memory for the color table (2 bits/block, same layout as
+	// gc.precise's mark bitmap) followed by the block pool.
+	colorTableSize := totalSize / (blocksPerStateByte * bytesPerBlock)
+	colorStart = heapStart
+
+	poolStart = (heapStart + colorTableSize + (bytesPerBlock - 1)) &^ (bytesPerBlock - 1)
+	poolEnd := heapEnd &^ (bytesPerBlock - 1)
+	numBlocks := (poolEnd - poolStart) / bytesPerBlock
+	endBlock = gcBlock(numBlocks)
+
+	if gcDebug {
+		println("concurrent gc: poolStart:", poolStart, "# of blocks:", numBlocks)
+	}
+
+	// Every block starts white (unknown), swept to free lazily as the
+	// allocator walks past it for the first time.
+	memzero(unsafe.Pointer(colorStart), colorTableSize)
+	sweepCursor = gcBlock(0)
+}
+
+// alloc allocates size bytes, making a small amount of incremental mark (or
+// lazy sweep) progress first if a cycle is running, and starting a new cycle
+// if the heap has grown enough since the last one finished. Unlike
+// gc.precise's alloc, it runs a full mark+sweep only when heapAlloc has run
+// out of free space; otherwise sweep, like marking, runs lazily on the
+// allocation path via sweepStep.
+func alloc(size uintptr) unsafe.Pointer {
+	if gcPhase == gcPhaseIdle && heapGrowthExceedsThreshold() {
+		startMarkCycle()
+	}
+	switch gcPhase {
+	case gcPhaseMarking:
+		markIncrement(markIncrementWork)
+	case gcPhaseSweeping:
+		sweepStep(markIncrementWork)
+	}
+
+	ptr := heapAlloc(size)
+	if ptr == nil {
+		// Out of lazily-swept free space: finish the current cycle (or run
+		// one from scratch) and try again before giving up.
+		if gcPhase == gcPhaseIdle {
+			startMarkCycle()
+		}
+		for gcPhase != gcPhaseIdle {
+			markIncrement(markIncrementWork)
+			if gcPhase == gcPhaseSweeping {
+				sweepStep(markIncrementWork)
+			}
+		}
+		ptr = heapAlloc(size)
+	}
+
+	if ptr != nil {
+		// Allocate black: this object didn't exist when startMarkCycle
+		// captured the root set, so without this it would look exactly like
+		// an unreached (white) object to the sweep phase currently in
+		// flight, and be freed out from under the mutator that just
+		// allocated it. A block the sweeper has already passed, or one
+		// allocated while idle, starts white instead, so that no object
+		// enters the next cycle already black (never scanned) or still
+		// colored gcFree (never shaded).
+		head := blockFromAddr(uintptr(ptr)).findHead()
+		if gcPhase == gcPhaseMarking || (gcPhase == gcPhaseSweeping && head >= sweepCursor) {
+			setColor(head, gcBlack)
+		} else {
+			setColor(head, gcWhite)
+		}
+	}
+	return ptr
+}
+
+// heapGrowthExceedsThreshold reports whether the heap has grown enough since
+// the last cycle finished to justify starting another one, per
+// gcGrowthRatio (the GOGC-style knob).
+func heapGrowthExceedsThreshold() bool {
+	if liveSizeAtLastGC == 0 {
+		return false
+	}
+	threshold := liveSizeAtLastGC + liveSizeAtLastGC*gcGrowthRatio/100
+	return currentHeapSize() > threshold
+}
+
+// startMarkCycle begins a new collection cycle: every reachable global and
+// stack root is shaded grey (not yet scanned), and marking proceeds from
+// there a little at a time on the allocation path.
+func startMarkCycle() {
+	if gcDebug {
+		println("\nconcurrent gc: starting cycle", gcPauseStats.cycles)
+	}
+	gcPauseStats.cycles++
+	gcPhase = gcPhaseMarking
+	greyQueue = greyQueue[:0]
+
+	markGlobals()
+	markStackRoots(getCurrentStackPointer(), stackTop)
+}
+
+// markGlobals shades every live pointer-typed package-level global grey, the
+// same trackedGlobalsStart/Length/Bitmap tables gc.precise's markGlobals
+// (gc_precise.go) reads - both collectors get them from the same compiler
+// pass (compiler.addGlobalsBitmap). Unlike that version, it shades (enqueues
+// for incremental scanning) instead of flipping a mark bit directly: this
+// collector's tricolor invariant wants every newly-discovered root grey, not
+// immediately black.
+//go:nobounds
+func markGlobals() {
+	for i := uintptr(0); i < trackedGlobalsLength; i++ {
+		if trackedGlobalsBitmap[i/8]&(1<<(i%8)) != 0 {
+			addr := trackedGlobalsStart + i*unsafe.Alignof(uintptr(0))
+			shade(*(*uintptr)(unsafe.Pointer(addr)))
+		}
+	}
+}
+
+// markStackRoots shades every word between start and end (exclusive) that
+// looks like a heap pointer grey - the same conservative, precise-stack-map-
+// free scan gc.precise's markStackRoots performs. It doesn't recurse into
+// the object immediately the way gc.precise's markRoot does: shade only
+// enqueues the block onto greyQueue, and markIncrement scans it (and shades
+// whatever it points to in turn) a little at a time.
+//
+// The start and end parameters must be valid pointers and must be aligned.
+func markStackRoots(start, end uintptr) {
+	if gcDebug {
+		println("concurrent gc: mark from", start, "to", end, int(end-start))
+	}
+	for addr := start; addr != end; addr += unsafe.Sizeof(addr) {
+		root := *(*uintptr)(unsafe.Pointer(addr))
+		shade(root)
+	}
+}
+
+// markIncrementWork is the number of grey objects scanned per call to
+// markIncrement, the unit of "a little at a time" mark progress.
+const markIncrementWork = 32
+
+// markIncrement scans up to n grey blocks, shading every pointer it finds
+// grey and then marking the scanned block black. Once the grey queue is
+// empty, the cycle moves to the sweep phase. It is a no-op once the cycle
+// has already moved past marking: callers such as GC()'s loop and alloc()
+// call this once per iteration regardless of phase, and without this guard
+// an already-sweeping cycle would have finishMarkCycle re-entered on every
+// such call, snapping sweepCursor back to the start and making it
+// impossible for sweepStep to ever reach endBlock.
+func markIncrement(n int) {
+	if gcPhase != gcPhaseMarking {
+		return
+	}
+	gcPauseStats.increments++
+	for i := 0; i < n && len(greyQueue) > 0; i++ {
+		addr := greyQueue[len(greyQueue)-1]
+		greyQueue = greyQueue[:len(greyQueue)-1]
+
+		block := blockFromAddr(addr)
+		scanBlock(block)
+		setColor(block, gcBlack)
+	}
+
+	if len(greyQueue) == 0 {
+		finishMarkCycle()
+	}
+}
+
+// scanBlock walks the words of block's object and shades every pointer it
+// finds into the heap, recursively growing the grey queue.
+func scanBlock(block gcBlock) {
+	head := block.findHead()
+	next := head.findNext()
+	for addr := head.address(); addr != next.address(); addr += unsafe.Sizeof(addr) {
+		root := *(*uintptr)(unsafe.Pointer(addr))
+		shade(root)
+	}
+}
+
+// shade marks a pointer grey if it refers to a heap object that is still
+// white, enqueuing it for scanning. It is a no-op for anything already grey
+// or black, and for anything that isn't a heap pointer at all.
+func shade(ptr uintptr) {
+	if !addressOnHeap(ptr) {
+		return
+	}
+	block := blockFromAddr(ptr).findHead()
+	if colorOf(block) == gcWhite {
+		setColor(block, gcGrey)
+		greyQueue = append(greyQueue, block.address())
+	}
+}
+
+// writeBarrier is called by compiler-inserted code (compiler.InsertWriteBarriers)
+// before every store of a pointer-typed value into heap or global memory. If a
+// mark cycle is running, it must shade the new value grey: without this, a
+// mutator could move the only reference to a white object from an
+// already-scanned (black) object into another black object, hiding it from
+// the collector for the rest of the cycle (the classic tricolor invariant
+// violation).
+func writeBarrier(slot, newVal unsafe.Pointer) {
+	if gcPhase != gcPhaseMarking {
+		return
+	}
+	shade(uintptr(newVal))
+}
+
+// finishMarkCycle moves from marking to sweeping once the grey queue has
+// drained: every block still white is garbage.
+func finishMarkCycle() {
+	if gcDebug {
+		println("concurrent gc: mark done, sweeping lazily")
+	}
+	gcPhase = gcPhaseSweeping
+	sweepCursor = gcBlock(0)
+}
+
+// sweepStep is called from the allocation path (alloc) and from GC() to
+// reclaim a bounded number of white blocks and flip survivors back to white
+// for the next cycle. Lazy sweeping means the cost of reclaiming memory is
+// spread across allocations instead of paid all at once.
+func sweepStep(maxBlocks int) (freed int) {
+	for freed < maxBlocks && sweepCursor < endBlock {
+		switch colorOf(sweepCursor) {
+		case gcWhite:
+			sweepCursor.setState(blockStateFree)
+			setColor(sweepCursor, gcFree)
+			freed++
+		case gcBlack:
+			// Survived this cycle: reset to white so the next cycle can
+			// prove reachability again from scratch.
+			setColor(sweepCursor, gcWhite)
+		}
+		sweepCursor++
+	}
+	if sweepCursor >= endBlock {
+		gcPhase = gcPhaseIdle
+		liveSizeAtLastGC = currentHeapSize()
+	}
+	return
+}
+
+// colorOf and setColor read/write a block's 2-bit color the same way
+// gc.precise's head.state()/setState() work, but against colorStart instead
+// of the mark bitmap.
+func colorOf(block gcBlock) gcColor {
+	index := uintptr(block)
+	b := *(*uint8)(unsafe.Pointer(colorStart + index/blocksPerStateByte))
+	shift := (index % blocksPerStateByte) * 2
+	return gcColor((b >> shift) & 0x3)
+}
+
+func setColor(block gcBlock, color gcColor) {
+	index := uintptr(block)
+	addr := colorStart + index/blocksPerStateByte
+	shift := (index % blocksPerStateByte) * 2
+	b := *(*uint8)(unsafe.Pointer(addr))
+	b = b&^(0x3<<shift) | uint8(color)<<shift
+	*(*uint8)(unsafe.Pointer(addr)) = b
+}
+
+// currentHeapSize reports how much of the pool is currently allocated
+// (non-free), used to decide when to start the next cycle and to record how
+// much survived the last one.
+func currentHeapSize() uintptr {
+	var size uintptr
+	for block := gcBlock(0); block < endBlock; block++ {
+		if colorOf(block) != gcFree {
+			size += bytesPerBlock
+		}
+	}
+	return size
+}
+
+// GC runs mark increments until a full cycle (mark and sweep) completes. It
+// exists for API compatibility with gc.precise's stop-the-world GC() and for
+// programs that want a deterministic collection point, but ordinary
+// allocation does not need to call it: alloc already makes incremental
+// progress on its own.
+func GC() {
+	if gcPhase == gcPhaseIdle {
+		startMarkCycle()
+	}
+	for gcPhase != gcPhaseIdle {
+		markIncrement(markIncrementWork)
+		if gcPhase == gcPhaseSweeping {
+			sweepStep(markIncrementWork)
+		}
+	}
+	if gcDebug {
+		println("concurrent gc: cycle", gcPauseStats.cycles, "increments so far:", gcPauseStats.increments)
+	}
+}
@@ -0,0 +1,49 @@
+// +build gc.concurrent
+
+package runtime
+
+import (
+	"testing"
+	"unsafe"
+)
+
+// TestConcurrentGCKeepsLiveObjectsDuringMark stresses allocation while a
+// mark cycle is in flight, forcing sweep to run lazily alongside it, and
+// confirms every object the mutator is still holding on to survives: the
+// scenario the original request asked to be covered, and the one the
+// allocate-black fix in alloc (see gc_concurrent.go) exists for. Without
+// that fix, objects allocated mid-cycle stay white and sweepStep reclaims
+// them as if they were garbage.
+func TestConcurrentGCKeepsLiveObjectsDuringMark(t *testing.T) {
+	const n = 4 * int(markIncrementWork)
+
+	roots := make([]unsafe.Pointer, 0, n)
+	for i := 0; i < n; i++ {
+		if i == n/4 {
+			// Force a cycle to be genuinely in flight (mid-marking, with a
+			// non-empty grey queue) for the remaining allocations below.
+			startMarkCycle()
+		}
+
+		ptr := alloc(unsafe.Sizeof(uintptr(0)))
+		if ptr == nil {
+			t.Fatalf("alloc(%d) returned nil", i)
+		}
+		roots = append(roots, ptr)
+	}
+
+	// Drive whatever cycle is left to completion.
+	for gcPhase != gcPhaseIdle {
+		markIncrement(markIncrementWork)
+		if gcPhase == gcPhaseSweeping {
+			sweepStep(markIncrementWork)
+		}
+	}
+
+	for i, ptr := range roots {
+		block := blockFromAddr(uintptr(ptr)).findHead()
+		if colorOf(block) == gcFree {
+			t.Fatalf("root %d (%v), allocated during a concurrent mark cycle, was swept as garbage", i, ptr)
+		}
+	}
+}
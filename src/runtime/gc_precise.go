@@ -20,10 +20,15 @@ var trackedGlobalsBitmap [0]uint8
 // any packages the runtime depends upon may not allocate memory during package
 // initialization.
 func init() {
-	totalSize := heapEnd - heapStart
-
 	// Allocate some memory to keep 2 bits of information about every block.
-	metadataSize := totalSize / (blocksPerStateByte * bytesPerBlock)
+	// metadataReserveSize (gc_precise_other.go / gc_precise_wasm.go) decides
+	// how much heap this needs to cover: on most targets that's simply the
+	// fixed heap the linker gave us, but on a target whose heap can grow
+	// after init (wasm) it has to cover the largest size the heap will ever
+	// reach, reserved up front, since poolStart below can never move once
+	// blocks have been allocated out of it.
+	metadataSize := metadataReserveSize()
+	reserveMetadata(metadataSize)
 
 	// Align the pool.
 	poolStart = (heapStart + metadataSize + (bytesPerBlock - 1)) &^ (bytesPerBlock - 1)
@@ -33,7 +38,7 @@ func init() {
 	if gcDebug {
 		println("heapStart:        ", heapStart)
 		println("heapEnd:          ", heapEnd)
-		println("total size:       ", totalSize)
+		println("total size:       ", heapEnd-heapStart)
 		println("metadata size:    ", metadataSize)
 		println("poolStart:        ", poolStart)
 		println("# of blocks:      ", numBlocks)
@@ -50,7 +55,13 @@ func init() {
 
 func alloc(size uintptr) unsafe.Pointer {
 	GC()
-	return heapAlloc(size)
+	ptr := heapAlloc(size)
+	if ptr == nil && growOnOOM(size) {
+		// The heap grew (wasm only, via memory.grow): try once more now that
+		// there's more room.
+		ptr = heapAlloc(size)
+	}
+	return ptr
 }
 
 // GC performs a garbage collection cycle.
@@ -61,7 +72,15 @@ func GC() {
 
 	// Mark phase: mark all reachable objects, recursively.
 	markGlobals()
-	markRoots(getCurrentStackPointer(), stackTop) // assume a descending stack
+	markStackRoots(getCurrentStackPointer(), stackTop) // assume a descending stack
+
+	// Keep every live arena's chunks from being swept, and scan what's been
+	// bump-allocated into them for outgoing pointers into the GC heap.
+	markArenas()
+
+	// Give any object with a pending finalizer one more cycle of life: mark
+	// it reachable and queue its finalizer, instead of letting sweep free it.
+	checkFinalizers()
 
 	// Sweep phase: free all non-marked objects and unmark marked objects for
 	// the next collection cycle.
@@ -84,15 +103,34 @@ func markGlobals() {
 	}
 }
 
-// markRoots reads all pointers from start to end (exclusive) and if they look
-// like a heap pointer and are unmarked, marks them and scans that object as
-// well (recursively). The start and end parameters must be valid pointers and
-// must be aligned.
-func markRoots(start, end uintptr) {
+// markStackRoots scans the stack between start and end (exclusive). This is
+// a conservative scan: every aligned word in range is treated as a possible
+// pointer into the heap, since nothing currently tells the GC which words of
+// a given frame actually hold one. Precise, stack-map-driven scanning does
+// not exist in this tree: an attempt was landed and then reverted, because
+// it only ever emitted the @llvm.experimental.stackmap intrinsic calls, with
+// nothing to parse the resulting .llvm_stackmaps section back into a lookup
+// table, and no arch-specific code ever reported whether a target's frame
+// pointers were reliable enough to walk in the first place - so it never
+// actually changed what got scanned, and this function has never done
+// anything but the conservative scan below. Two things are still needed
+// before that changes: a reader for the stackmap section, and a per-arch
+// frame-pointer-availability flag.
+//
+// The start and end parameters must be valid pointers and must be aligned.
+func markStackRoots(start, end uintptr) {
 	if gcDebug {
 		println("mark from", start, "to", end, int(end-start))
 	}
+	markRoots(start, end)
+}
 
+// markRoots reads all pointers from start to end (exclusive) and if they look
+// like a heap pointer and are unmarked, marks them and scans that object as
+// well (recursively). The start and end parameters must be valid pointers and
+// must be aligned. Used both to scan the stack and to scan the body of heap
+// objects, which have no frame information at all.
+func markRoots(start, end uintptr) {
 	for addr := start; addr != end; addr += unsafe.Sizeof(addr) {
 		root := *(*uintptr)(unsafe.Pointer(addr))
 		markRoot(addr, root)
@@ -0,0 +1,152 @@
+// +build gc.precise
+
+package runtime
+
+import "unsafe"
+
+// finalizerEntry records the closure to run once an object becomes
+// unreachable, along with the type the runtime needs to rebuild the
+// interface{} value passed to it (objType comes straight from obj's own
+// interface header, via interfaceTypePointer, at SetFinalizer time).
+type finalizerEntry struct {
+	addr    uintptr     // head-block address of the finalized object
+	fn      interface{} // the func(interface{}) passed to SetFinalizer
+	objType *uint8      // runtime type descriptor for the object, used to rebuild its interface value
+}
+
+// finalizers holds one entry per object with a pending finalizer, keyed by
+// the object's head-block address. It is small and linearly searched:
+// programs that call SetFinalizer do so rarely enough (compared to regular
+// allocation) that this isn't worth a real hash table.
+var finalizers []finalizerEntry
+
+// finalizerQueue holds objects that were found unreachable and whose
+// finalizer still needs to run. runFinalizers drains it on a dedicated
+// goroutine so that finalizers never run during the collector's mark phase.
+var finalizerQueue = make(chan finalizerEntry, 16)
+
+func init() {
+	go runFinalizers()
+}
+
+// runFinalizers drains finalizerQueue for as long as the program runs,
+// invoking one finalizer at a time. It is started once, from this package's
+// init, using the same goroutine machinery (compiler.LowerGoroutines) as any
+// other `go` statement.
+func runFinalizers() {
+	for entry := range finalizerQueue {
+		obj := makeInterface(entry.objType, unsafe.Pointer(entry.addr))
+		callFinalizer(entry.fn, obj)
+	}
+}
+
+// SetFinalizer arranges for finalizer to be called after obj becomes
+// unreachable, modeled on Go's runtime/mfinal.go. Passing a nil finalizer
+// clears any finalizer previously registered for obj. A finalizer is called
+// at most once; if obj is part of a reference cycle that also has a
+// finalizer, neither will ever run (as in upstream Go, cyclic finalized
+// garbage is leaked rather than guessed at).
+//
+// Unlike upstream Go, finalizer's dynamic type must be exactly
+// func(interface{}): this runtime has no devirtualization pass to recover a
+// concrete func(T) from the interface{} SetFinalizer receives it as, so
+// callFinalizer type-asserts it directly instead. A finalizer of any other
+// type panics the first time it would run, not when SetFinalizer is called.
+func SetFinalizer(obj interface{}, finalizer interface{}) {
+	addr := interfaceDataPointer(obj)
+	head := blockFromAddr(addr).findHead()
+
+	if finalizer == nil {
+		removeFinalizer(head.address())
+		return
+	}
+
+	removeFinalizer(head.address()) // a second SetFinalizer call replaces the first
+	finalizers = append(finalizers, finalizerEntry{
+		addr:    head.address(),
+		fn:      finalizer,
+		objType: interfaceTypePointer(obj),
+	})
+}
+
+// makeInterface, interfaceTypePointer, and interfaceDataPointer reach into
+// the two-word {typecode, value} layout that the rest of the interface
+// machinery (runtime/interface.go's _interface type) already uses, so the
+// finalizer queue can carry a plain type pointer and data address instead of
+// pinning a whole interface{} (which markStackRoots would otherwise have to
+// treat as two separate, differently-typed roots).
+func makeInterface(typecode *uint8, data unsafe.Pointer) interface{} {
+	i := _interface{typecode: uintptr(unsafe.Pointer(typecode)), value: data}
+	return *(*interface{})(unsafe.Pointer(&i))
+}
+
+func interfaceTypePointer(i interface{}) *uint8 {
+	raw := (*_interface)(unsafe.Pointer(&i))
+	return (*uint8)(unsafe.Pointer(raw.typecode))
+}
+
+func interfaceDataPointer(i interface{}) uintptr {
+	raw := (*_interface)(unsafe.Pointer(&i))
+	return uintptr(raw.value)
+}
+
+// callFinalizer invokes fn (the finalizer passed to SetFinalizer) with obj,
+// the object it was registered for, boxed back up as interface{} by
+// runFinalizers. See SetFinalizer's doc comment: fn's dynamic type must be
+// func(interface{}), and this panics if it isn't.
+func callFinalizer(fn interface{}, obj interface{}) {
+	fn.(func(interface{}))(obj)
+}
+
+func removeFinalizer(addr uintptr) {
+	for i, entry := range finalizers {
+		if entry.addr == addr {
+			finalizers = append(finalizers[:i], finalizers[i+1:]...)
+			return
+		}
+	}
+}
+
+// checkFinalizers is called from GC() (gc_precise.go) after marking but
+// before sweeping. Any object that is about to be swept but still has a
+// pending finalizer is resurrected instead: it is re-marked as reachable (so
+// sweep leaves it alone) and its finalizer is moved onto finalizerQueue to
+// run exactly once, after which it is no longer tracked and a future cycle
+// may collect it for real. An object reachable from another object with a
+// pending finalizer (including through a cycle) is not queued and keeps its
+// finalizer pending.
+func checkFinalizers() {
+	if len(finalizers) == 0 {
+		return
+	}
+
+	// Mark everything an unreached finalized object points to, but not the
+	// object itself: one that gets marked this way is reachable from another
+	// finalized object, or from itself through a cycle.
+	for _, entry := range finalizers {
+		block := blockFromAddr(entry.addr).findHead()
+		if block.state() != blockStateMark {
+			markRoots(block.address(), block.findNext().address())
+		}
+	}
+
+	var stillPending []finalizerEntry
+	for _, entry := range finalizers {
+		block := blockFromAddr(entry.addr).findHead()
+		if block.state() == blockStateMark {
+			// Already reachable through some other path; keep waiting.
+			stillPending = append(stillPending, entry)
+			continue
+		}
+
+		// Resurrect: mark it and everything it points to, same as any other
+		// root, so sweep doesn't free it out from under the queued
+		// finalizer.
+		block.setState(blockStateMark)
+		next := block.findNext()
+		markRoots(block.address(), next.address())
+
+		finalizerQueue <- entry
+	}
+	finalizers = stillPending
+}
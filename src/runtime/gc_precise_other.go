@@ -0,0 +1,24 @@
+// +build gc.precise,!wasm
+
+package runtime
+
+// growOnOOM reports whether the heap could be grown to satisfy an allocation
+// that didn't fit. Only the wasm target can grow its heap on demand (via
+// memory.grow, see gc_precise_wasm.go); everywhere else the heap size is
+// fixed at link time, so there is nothing to try.
+func growOnOOM(size uintptr) bool {
+	return false
+}
+
+// metadataReserveSize returns how many bytes of bitmap gc_precise.go's init
+// should reserve to track the heap. Everywhere but wasm the heap never
+// grows after init, so this is just enough to cover the fixed heap the
+// linker gave us - the same size the pool itself ends up bounded to.
+func metadataReserveSize() uintptr {
+	return (heapEnd - heapStart) / (blocksPerStateByte * bytesPerBlock)
+}
+
+// reserveMetadata is a no-op everywhere but wasm: the memory backing
+// metadataReserveSize's bytes is already committed by the time init runs,
+// since the heap can't grow later anyway.
+func reserveMetadata(metadataSize uintptr) {}
@@ -0,0 +1,131 @@
+// +build gc.precise,wasm
+
+package runtime
+
+// heapGrowthDoublingLimit is the heap size (in bytes) up to which each growth
+// doubles the heap; beyond it, growth falls back to adding fixed-size
+// increments, so a long-running program doesn't reserve wasm pages far
+// faster than it actually needs them.
+const heapGrowthDoublingLimit = 4 * 1024 * 1024 // 4 MiB
+
+// heapGrowthIncrement is the fixed amount added per growth once the heap is
+// past heapGrowthDoublingLimit.
+const heapGrowthIncrement = 1 * 1024 * 1024 // 1 MiB
+
+// wasmMaxHeapSize is the largest size growOnOOM will ever grow the heap to.
+// metadataReserveSize sizes the mark bitmap for this much heap up front, at
+// init, rather than growing the bitmap alongside the pool later: the bitmap
+// always starts at heapStart, and poolStart (gc_precise.go's init) is
+// derived directly from its size, so once any block has been allocated out
+// of the pool the bitmap can never be made bigger without either moving
+// poolStart (corrupting already-allocated objects in what used to be pool
+// bytes) or moving the bitmap itself out from under the block state
+// accessors that assume it lives at heapStart. Reserving for the worst case
+// up front avoids both.
+const wasmMaxHeapSize = 256 * 1024 * 1024 // 256 MiB
+
+// growOnOOM is called from alloc (gc_precise.go) after a regular allocation
+// attempt fails. It grows the wasm linear memory to make room for at least
+// size more bytes and extends the block pool to cover it. It reports false
+// if the wasm runtime refused to grow memory further (memory.maximum
+// reached) or if the heap has already reached wasmMaxHeapSize, in which
+// case the caller should report an out-of-memory condition as before.
+func growOnOOM(size uintptr) bool {
+	currentSize := heapEnd - heapStart
+	growBy := currentSize
+	if currentSize >= heapGrowthDoublingLimit {
+		growBy = heapGrowthIncrement
+	}
+	if growBy < size {
+		// Whatever the policy says, always grow enough to satisfy the
+		// allocation that triggered this call.
+		growBy = size
+	}
+
+	if currentSize+growBy > wasmMaxHeapSize {
+		growBy = wasmMaxHeapSize - currentSize
+		if growBy < size {
+			return false
+		}
+	}
+
+	pages := (growBy + wasmPageSize - 1) / wasmPageSize
+	_, ok := growHeap(pages)
+	if !ok {
+		return false
+	}
+
+	extendPool(heapEnd + pages*wasmPageSize)
+	return true
+}
+
+// extendPool grows the block pool to cover the heap up to newHeapEnd. It
+// never touches poolStart or the metadata region at heapStart:
+// metadataReserveSize already reserved, and reserveMetadata already backed
+// with real memory, enough bitmap to cover the heap all the way up to
+// wasmMaxHeapSize, so growing the pool here can't reinterpret already-live
+// object bytes as metadata. init already zeroed the whole reserved bitmap,
+// and nothing sets the bits of blocks past endBlock, so the bits for the
+// newly covered blocks are still zero (free) and need no extra
+// initialization.
+func extendPool(newHeapEnd uintptr) {
+	heapEnd = newHeapEnd
+	poolEnd := heapEnd &^ (bytesPerBlock - 1)
+	endBlock = gcBlock((poolEnd - poolStart) / bytesPerBlock)
+
+	if gcDebug {
+		println("gc: grew heap, new heapEnd:", heapEnd, "new # of blocks:", uintptr(endBlock))
+	}
+}
+
+// metadataReserveSize returns enough bytes of bitmap to track the heap all
+// the way up to wasmMaxHeapSize, computed up front so poolStart never has
+// to move as growOnOOM grows the heap later (see wasmMaxHeapSize).
+func metadataReserveSize() uintptr {
+	return wasmMaxHeapSize / (blocksPerStateByte * bytesPerBlock)
+}
+
+// reserveMetadata grows the wasm heap, if needed, so that real memory
+// already backs metadataSize bytes of bitmap plus at least one page of
+// actual pool, and updates heapEnd to match. It runs once, from
+// gc_precise.go's init, before poolStart/poolEnd are computed: growing wasm
+// linear memory is the only way to reserve address space for it at all,
+// since there is no mmap-style reservation without backing pages.
+func reserveMetadata(metadataSize uintptr) {
+	need := metadataSize + wasmPageSize
+	current := heapEnd - heapStart
+	if current >= need {
+		return
+	}
+	pages := (need - current + wasmPageSize - 1) / wasmPageSize
+	if _, ok := growHeap(pages); !ok {
+		// The host refused (its memory.maximum is smaller than even the
+		// metadata reservation): fall back to whatever is already
+		// committed. The heap ends up with far fewer blocks than
+		// wasmMaxHeapSize implies, and growOnOOM will fail once that's
+		// exhausted, same as before this fix.
+		return
+	}
+	heapEnd += pages * wasmPageSize
+}
+
+// MemStats reports a snapshot of heap usage, similar in spirit to Go's
+// runtime.MemStats but scaled down to what this allocator can cheaply track.
+type MemStats struct {
+	HeapSize  uintptr // current size of the heap, in bytes
+	HeapInUse uintptr // bytes currently allocated (not free)
+}
+
+// ReadMemStats populates m with the current heap size and usage. It's the
+// main way to observe the effect of the growable wasm heap from a program.
+func ReadMemStats(m *MemStats) {
+	m.HeapSize = heapEnd - heapStart
+
+	var inUse uintptr
+	for block := gcBlock(0); block < endBlock; block++ {
+		if block.state() != blockStateFree {
+			inUse += bytesPerBlock
+		}
+	}
+	m.HeapInUse = inUse
+}